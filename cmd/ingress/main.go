@@ -17,23 +17,21 @@ limitations under the License.
 package main
 
 import (
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
-	cloudevents "github.com/cloudevents/sdk-go/v2"
 	"github.com/cloudevents/sdk-go/v2/binding"
 	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
 	"github.com/google/uuid"
 	"github.com/kelseyhightower/envconfig"
-	amqp "github.com/rabbitmq/amqp091-go"
 	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
 	"go.opencensus.io/trace"
 	"go.uber.org/zap"
 	"knative.dev/eventing-rabbitmq/pkg/broker/ingress"
-	"knative.dev/eventing-rabbitmq/pkg/rabbit"
+	"knative.dev/eventing-rabbitmq/pkg/publisher"
 	"knative.dev/eventing-rabbitmq/pkg/utils"
 	"knative.dev/eventing/pkg/kncloudevents"
 	"knative.dev/pkg/kmeta"
@@ -58,8 +56,37 @@ type envConfig struct {
 	BrokerURL    string `envconfig:"BROKER_URL" required:"true"`
 	ExchangeName string `envconfig:"EXCHANGE_NAME" required:"true"`
 
-	connection *amqp.Connection
-	channel    *amqp.Channel
+	// HealthPort serves the /healthz readiness probe and the /metrics
+	// Prometheus scrape endpoint (see publisher.MetricsHandler) on its own
+	// port, separate from the CloudEvents ingestion path.
+	HealthPort int `envconfig:"HEALTH_PORT" default:"9090"`
+
+	// Protocol selects which publisher.Publisher talks to RabbitMQ on
+	// behalf of this ingress.
+	Protocol   string `envconfig:"PROTOCOL" default:"amqp091"`
+	StreamName string `envconfig:"STREAM_NAME"`
+
+	// CEEncoding selects structured (application/cloudevents+json) or
+	// binary (cloudEvents: prefixed AMQP headers) CloudEvents content mode.
+	CEEncoding string `envconfig:"CE_ENCODING" default:"structured"`
+
+	MaxInFlight      int           `envconfig:"MAX_IN_FLIGHT" default:"1000"`
+	ConfirmTimeout   time.Duration `envconfig:"CONFIRM_TIMEOUT" default:"5s"`
+	NackMaxRetries   int           `envconfig:"NACK_MAX_RETRIES" default:"3"`
+	NackRetryBackoff time.Duration `envconfig:"NACK_RETRY_BACKOFF" default:"100ms"`
+
+	// DrainTimeout bounds how long shutdown waits for in-flight publishes
+	// to finish before closing the publisher anyway.
+	DrainTimeout time.Duration `envconfig:"DRAIN_TIMEOUT" default:"10s"`
+	// TerminationGracePeriodSeconds should match the Pod's own
+	// terminationGracePeriodSeconds. Shutdown spends
+	// TerminationGracePeriodSeconds-DrainTimeout failing the readiness
+	// probe before it starts draining, so Kubernetes has time to stop
+	// routing new requests to this pod first.
+	TerminationGracePeriodSeconds int `envconfig:"TERMINATION_GRACE_PERIOD_SECONDS" default:"30"`
+
+	pub      publisher.Publisher
+	shutdown *shutdownCoordinator
 
 	ContainerName   string `envconfig:"CONTAINER_NAME" default:"ingress"`
 	PodName         string `envconfig:"POD_NAME" default:"rabbitmq-broker-ingress"`
@@ -93,28 +120,42 @@ func main() {
 		logger.Errorw("failed to create the metrics exporter", zap.Error(err))
 	}
 
-	rmqHelper := rabbit.NewRabbitMQHelper(1)
-	retryChannel := make(chan bool)
-	// Wait for RabbitMQ retry messages
+	env.pub, err = publisher.New(publisher.Protocol(env.Protocol), publisher.Config{
+		BrokerURL:        env.BrokerURL,
+		ExchangeName:     env.ExchangeName,
+		StreamName:       env.StreamName,
+		Encoding:         publisher.CEEncoding(env.CEEncoding),
+		MaxInFlight:      env.MaxInFlight,
+		ConfirmTimeout:   env.ConfirmTimeout,
+		NackMaxRetries:   env.NackMaxRetries,
+		NackRetryBackoff: env.NackRetryBackoff,
+	}, logger)
+	if err != nil {
+		logger.Fatalf("failed to create %s publisher: %v", env.Protocol, err)
+	}
+
+	preStopDelay := time.Duration(env.TerminationGracePeriodSeconds)*time.Second - env.DrainTimeout
+	if preStopDelay < 0 {
+		preStopDelay = 0
+	}
+	env.shutdown = newShutdownCoordinator(preStopDelay, env.DrainTimeout)
+	go env.shutdown.run(ctx, logger)
+
 	go func() {
-		for {
-			if retry := <-retryChannel; !retry {
-				logger.Warn("stopped listenning for RabbitMQ resources retries")
-				close(retryChannel)
-				break
-			}
-			logger.Warn("recreating RabbitMQ resources")
-			env.connection, env.channel, err = env.CreateRabbitMQConnections(rmqHelper, retryChannel, logger)
-			if err != nil {
-				logger.Errorf("error recreating RabbitMQ connections: %s, waiting for a retry", err)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", func(writer http.ResponseWriter, _ *http.Request) {
+			if !env.shutdown.ready() {
+				writer.WriteHeader(http.StatusServiceUnavailable)
+				return
 			}
+			writer.WriteHeader(http.StatusOK)
+		})
+		mux.Handle("/metrics", publisher.MetricsHandler())
+		addr := fmt.Sprintf(":%d", env.HealthPort)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Errorw("health server stopped", zap.Error(err))
 		}
 	}()
-	env.connection, env.channel, err = env.CreateRabbitMQConnections(rmqHelper, retryChannel, logger)
-	if err != nil {
-		logger.Errorf("error creating RabbitMQ connections: %s, waiting for a retry", err)
-	}
-	defer rmqHelper.CleanupRabbitMQ(env.connection, env.channel, retryChannel, logger)
 
 	env.reporter = ingress.NewStatsReporter(env.ContainerName, kmeta.ChildName(env.PodName, uuid.New().String()))
 
@@ -124,13 +165,37 @@ func main() {
 	}
 	kncloudevents.ConfigureConnectionArgs(&connectionArgs)
 	receiver := kncloudevents.NewHTTPMessageReceiver(env.Port)
-	if err = receiver.StartListen(ctx, &env); err != nil {
+
+	// receiver.StartListen tears its HTTP server down as soon as its ctx is
+	// done, so it can't be handed the signal context directly: that would
+	// stop accepting (and draining) requests the instant SIGTERM arrives,
+	// during the very preStopDelay/drain window shutdown exists to cover.
+	// Give it a context that's only cancelled once shutdown has finished
+	// failing readiness and draining in-flight publishes.
+	listenCtx, stopListening := context.WithCancel(context.Background())
+	go func() {
+		env.shutdown.wait()
+		stopListening()
+	}()
+
+	if err = receiver.StartListen(listenCtx, &env); err != nil {
 		logger.Fatalf("failed to start listen, %v", err)
 	}
+
+	// By the time StartListen has returned, shutdown has already drained
+	// (or given up waiting for) every in-flight publish, so it's safe to
+	// close the publisher and the AMQP channel/connection any of them were
+	// awaiting a confirm on.
+	env.pub.Close()
 }
 
 func (env *envConfig) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	logger := env.GetLogger()
+	env.serveCloudEvent(env.GetLogger(), writer, request)
+}
+
+// serveCloudEvent is ServeHTTP's logic with the logger taken as a parameter
+// so tests can drive it without going through utils.EnvConfig's logger setup.
+func (env *envConfig) serveCloudEvent(logger *zap.SugaredLogger, writer http.ResponseWriter, request *http.Request) {
 	// validate request method
 	if request.Method != http.MethodPost {
 		logger.Warn("unexpected request method", zap.String("method", request.Method))
@@ -173,7 +238,10 @@ func (env *envConfig) ServeHTTP(writer http.ResponseWriter, request *http.Reques
 		EventType:  event.Type(),
 	}
 
-	statusCode, dispatchTime, err := env.send(event, span)
+	tp, ts := (&tracecontext.HTTPFormat{}).SpanContextToHeaders(span.SpanContext())
+	publishDone := env.shutdown.trackPublish()
+	statusCode, dispatchTime, retryAfter, err := env.pub.Send(ctx, event, tp, ts)
+	publishDone()
 	if err != nil {
 		logger.Errorw("failed to send event", zap.Error(err))
 	}
@@ -182,65 +250,8 @@ func (env *envConfig) ServeHTTP(writer http.ResponseWriter, request *http.Reques
 	}
 	_ = env.reporter.ReportEventCount(reporterArgs, statusCode)
 
-	writer.WriteHeader(statusCode)
-}
-
-func (env *envConfig) send(event *cloudevents.Event, span *trace.Span) (int, time.Duration, error) {
-	bytes, err := json.Marshal(event)
-	if err != nil {
-		return http.StatusBadRequest, noDuration, fmt.Errorf("failed to marshal event, %w", err)
-	}
-
-	tp, ts := (&tracecontext.HTTPFormat{}).SpanContextToHeaders(span.SpanContext())
-	headers := amqp.Table{
-		"type":        event.Type(),
-		"source":      event.Source(),
-		"subject":     event.Subject(),
-		"traceparent": tp,
-		"tracestate":  ts,
-	}
-
-	for key, val := range event.Extensions() {
-		headers[key] = val
-	}
-	start := time.Now()
-	dc, err := env.channel.PublishWithDeferredConfirm(
-		env.ExchangeName,
-		"",    // routing key
-		false, // mandatory
-		false, // immediate
-		amqp.Publishing{
-			Headers:      headers,
-			ContentType:  "application/json",
-			Body:         bytes,
-			DeliveryMode: amqp.Persistent,
-		})
-
-	if err != nil {
-		return http.StatusInternalServerError, noDuration, fmt.Errorf("failed to publish message: %w", err)
-	}
-
-	ack := dc.Wait()
-	dispatchTime := time.Since(start)
-	if !ack {
-		return http.StatusInternalServerError, noDuration, errors.New("failed to publish message: nacked")
-	}
-	return http.StatusAccepted, dispatchTime, nil
-}
-
-func (env *envConfig) CreateRabbitMQConnections(
-	rmqHelper *rabbit.RabbitMQHelper,
-	retryChannel chan<- bool,
-	logger *zap.SugaredLogger) (conn *amqp.Connection, channel *amqp.Channel, err error) {
-	conn, channel, err = rmqHelper.SetupRabbitMQ(env.BrokerURL, retryChannel, logger)
-	if err == nil {
-		err = channel.Confirm(false)
-	}
-	if err != nil {
-		rmqHelper.CloseRabbitMQConnections(conn, channel, logger)
-		go rmqHelper.SignalRetry(retryChannel, true)
-		return nil, nil, err
+	if retryAfter > 0 {
+		writer.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
 	}
-
-	return conn, channel, nil
+	writer.WriteHeader(statusCode)
 }
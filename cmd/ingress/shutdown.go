@@ -0,0 +1,130 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// shutdownCoordinator lets ServeHTTP and main agree on when it's safe to
+// close the publisher without either dropping an in-flight publish or
+// blocking the pod's termination forever. Without it, a SIGTERM can close
+// the AMQP channel out from under a goroutine still awaiting a publisher
+// confirm, turning what would have been a successful publish into a
+// spurious 500.
+type shutdownCoordinator struct {
+	preStopDelay time.Duration
+	drainTimeout time.Duration
+
+	notReady int32 // atomic bool; set as soon as shutdown starts, read by the readiness probe
+
+	// inFlight/draining/drainDone replace a sync.WaitGroup: trackPublish
+	// keeps accepting new Adds (from requests that arrive during
+	// preStopDelay or later) after run has already called Wait once draining
+	// begins, which a WaitGroup forbids - "Add called concurrently with
+	// Wait" is a misuse panic, not just a race.
+	mu        sync.Mutex
+	inFlight  int
+	draining  bool
+	drainDone chan struct{} // closed once inFlight reaches zero after draining begins
+	once      sync.Once
+
+	drained chan struct{} // closed once it's safe to close the publisher
+}
+
+func newShutdownCoordinator(preStopDelay, drainTimeout time.Duration) *shutdownCoordinator {
+	return &shutdownCoordinator{
+		preStopDelay: preStopDelay,
+		drainTimeout: drainTimeout,
+		drainDone:    make(chan struct{}),
+		drained:      make(chan struct{}),
+	}
+}
+
+// trackPublish marks the start of a publish that should complete (or be
+// abandoned on timeout) before the publisher is closed, and returns a func
+// to call once it's done.
+func (s *shutdownCoordinator) trackPublish() (done func()) {
+	s.mu.Lock()
+	s.inFlight++
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		s.inFlight--
+		done := s.draining && s.inFlight == 0
+		s.mu.Unlock()
+		if done {
+			s.once.Do(func() { close(s.drainDone) })
+		}
+	}
+}
+
+// startDraining marks that no further publishes are expected once the
+// ones already in flight finish, and closes drainDone immediately if none
+// are in flight right now.
+func (s *shutdownCoordinator) startDraining() {
+	s.mu.Lock()
+	s.draining = true
+	done := s.inFlight == 0
+	s.mu.Unlock()
+	if done {
+		s.once.Do(func() { close(s.drainDone) })
+	}
+}
+
+// ready reports whether the readiness probe should currently pass. It goes
+// false the moment run's context is cancelled, before a single in-flight
+// publish has necessarily finished, so Kubernetes can stop routing new
+// traffic to this pod while it's still serving the requests already in
+// flight.
+func (s *shutdownCoordinator) ready() bool {
+	return atomic.LoadInt32(&s.notReady) == 0
+}
+
+// run blocks until ctx is done, then fails the readiness probe, waits
+// preStopDelay for Kubernetes to notice and stop sending new traffic, and
+// finally waits for every publish tracked by trackPublish to finish,
+// bounded by drainTimeout. The caller must wait for run to return before
+// closing the publisher.
+func (s *shutdownCoordinator) run(ctx context.Context, logger *zap.SugaredLogger) {
+	<-ctx.Done()
+	defer close(s.drained)
+
+	atomic.StoreInt32(&s.notReady, 1)
+	logger.Infof("shutdown: failing readiness probe and waiting %s before draining in-flight publishes", s.preStopDelay)
+	time.Sleep(s.preStopDelay)
+
+	s.startDraining()
+
+	select {
+	case <-s.drainDone:
+		logger.Info("shutdown: all in-flight publishes drained")
+	case <-time.After(s.drainTimeout):
+		logger.Warnf("shutdown: drain timeout %s elapsed with publishes still in flight, closing anyway", s.drainTimeout)
+	}
+}
+
+// wait blocks until run has finished failing readiness and draining.
+func (s *shutdownCoordinator) wait() {
+	<-s.drained
+}
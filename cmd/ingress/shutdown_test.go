@@ -0,0 +1,141 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+	"knative.dev/eventing-rabbitmq/pkg/broker/ingress"
+)
+
+// noopStatsReporter discards the dispatch time/count reports ServeHTTP
+// makes on every request, so tests don't need a real metrics backend.
+type noopStatsReporter struct{}
+
+func (noopStatsReporter) ReportEventDispatchTime(*ingress.ReportArgs, int, time.Duration) error {
+	return nil
+}
+
+func (noopStatsReporter) ReportEventCount(*ingress.ReportArgs, int) error { return nil }
+
+// slowConfirmPublisher simulates an AMQP publisher whose confirm takes a
+// while to arrive, so tests can assert that a shutdown in progress doesn't
+// fail a request that was already in flight.
+type slowConfirmPublisher struct {
+	confirmAfter time.Duration
+	closed       chan struct{}
+}
+
+func newSlowConfirmPublisher(confirmAfter time.Duration) *slowConfirmPublisher {
+	return &slowConfirmPublisher{confirmAfter: confirmAfter, closed: make(chan struct{})}
+}
+
+func (p *slowConfirmPublisher) Send(ctx context.Context, event *cloudevents.Event, traceParent, traceState string) (int, time.Duration, time.Duration, error) {
+	select {
+	case <-time.After(p.confirmAfter):
+		return http.StatusAccepted, p.confirmAfter, 0, nil
+	case <-p.closed:
+		return http.StatusInternalServerError, 0, 0, context.Canceled
+	}
+}
+
+func (p *slowConfirmPublisher) Close() error {
+	close(p.closed)
+	return nil
+}
+
+func newTestCloudEventRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"hello":"world"}`))
+	req.Header.Set("Ce-Specversion", "1.0")
+	req.Header.Set("Ce-Type", "dev.knative.test")
+	req.Header.Set("Ce-Source", "shutdown-test")
+	req.Header.Set("Ce-Id", "1")
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// TestShutdownDrainsInFlightPublishes asserts that a publish already in
+// flight when shutdown begins completes successfully instead of racing the
+// publisher's Close.
+func TestShutdownDrainsInFlightPublishes(t *testing.T) {
+	pub := newSlowConfirmPublisher(100 * time.Millisecond)
+
+	var env envConfig
+	env.pub = pub
+	env.reporter = noopStatsReporter{}
+	env.shutdown = newShutdownCoordinator(0, time.Second)
+
+	logger := zap.NewNop().Sugar()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var status int
+	go func() {
+		defer wg.Done()
+		rec := httptest.NewRecorder()
+		env.serveCloudEvent(logger, rec, newTestCloudEventRequest())
+		status = rec.Code
+	}()
+
+	// Give the handler a moment to start its publish before shutdown begins,
+	// so the in-flight counter is non-zero when draining starts.
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	env.shutdown.run(ctx, logger)
+	env.shutdown.wait()
+
+	wg.Wait()
+
+	if status != http.StatusAccepted {
+		t.Fatalf("expected in-flight publish to complete with 202, got %d", status)
+	}
+}
+
+// TestShutdownReadinessFailsImmediately asserts the readiness probe fails
+// as soon as shutdown starts, without waiting for the drain to finish.
+func TestShutdownReadinessFailsImmediately(t *testing.T) {
+	s := newShutdownCoordinator(0, 50*time.Millisecond)
+	done := s.trackPublish()
+	defer done()
+
+	if !s.ready() {
+		t.Fatal("expected coordinator to be ready before shutdown starts")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	go s.run(ctx, zap.NewNop().Sugar())
+
+	deadline := time.After(time.Second)
+	for s.ready() {
+		select {
+		case <-deadline:
+			t.Fatal("readiness probe never failed after shutdown began")
+		default:
+		}
+	}
+}
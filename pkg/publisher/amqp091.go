@@ -0,0 +1,220 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.uber.org/zap"
+	"knative.dev/eventing-rabbitmq/pkg/rabbit"
+)
+
+// amqp091Publisher publishes CloudEvents to a classic AMQP 0-9-1 exchange
+// using publisher confirms, batched through an outbox so many concurrent
+// Send calls share one channel instead of serializing on it.
+type amqp091Publisher struct {
+	cfg    Config
+	logger *zap.SugaredLogger
+
+	rmqHelper *rabbit.RabbitMQHelper
+
+	mu         sync.RWMutex
+	connection *amqp.Connection
+	channel    *amqp.Channel
+	box        *outbox
+
+	// publishMu serializes GetNextPublishSeqNo, Publish, and registering the
+	// resulting delivery tag with the outbox. Without it, two concurrent
+	// Send calls can both read the same next sequence number before either
+	// publishes, so the second call's outbox registration overwrites the
+	// first's - the broker still assigns them distinct tags, so one confirm
+	// resolves the wrong waiter and the other times out.
+	publishMu sync.Mutex
+}
+
+func newAMQP091Publisher(cfg Config, logger *zap.SugaredLogger) (Publisher, error) {
+	p := &amqp091Publisher{
+		cfg:       cfg,
+		logger:    logger,
+		rmqHelper: rabbit.NewRabbitMQHelper(1),
+	}
+
+	if cfg.RetryChannel == nil {
+		cfg.RetryChannel = make(chan bool)
+	}
+	p.cfg.RetryChannel = cfg.RetryChannel
+	go func() {
+		for retry := range cfg.RetryChannel {
+			if !retry {
+				logger.Warn("stopped listening for RabbitMQ resources retries")
+				return
+			}
+			logger.Warn("recreating RabbitMQ resources")
+			if err := p.connect(cfg.RetryChannel); err != nil {
+				logger.Errorf("error recreating RabbitMQ connections: %s, waiting for a retry", err)
+			}
+		}
+	}()
+
+	if err := p.connect(cfg.RetryChannel); err != nil {
+		logger.Errorf("error creating RabbitMQ connections: %s, waiting for a retry", err)
+	}
+
+	return p, nil
+}
+
+func (p *amqp091Publisher) connect(retryChannel chan bool) error {
+	conn, channel, err := p.rmqHelper.SetupRabbitMQ(p.cfg.BrokerURL, retryChannel, p.logger)
+	if err == nil {
+		err = channel.Confirm(false)
+	}
+	if err != nil {
+		p.rmqHelper.CloseRabbitMQConnections(conn, channel, p.logger)
+		go p.rmqHelper.SignalRetry(retryChannel, true)
+		return err
+	}
+
+	p.mu.Lock()
+	if p.box != nil {
+		p.box.failAll(errChannelReset)
+	}
+	p.connection, p.channel = conn, channel
+	p.box = newOutbox(channel, p.cfg.MaxInFlight, p.logger)
+	p.mu.Unlock()
+
+	recordConnectionChurn(string(ProtocolAMQP091))
+
+	return nil
+}
+
+func (p *amqp091Publisher) Send(ctx context.Context, event *cloudevents.Event, traceParent, traceState string) (int, time.Duration, time.Duration, error) {
+	bytes, headers, contentType, err := encodeAMQPMessage(p.cfg.Encoding, event, traceParent, traceState)
+	if err != nil {
+		return http.StatusBadRequest, noDispatchTime, 0, fmt.Errorf("failed to encode event, %w", err)
+	}
+
+	publishing := amqp.Publishing{
+		Headers:      headers,
+		ContentType:  contentType,
+		Body:         bytes,
+		DeliveryMode: amqp.Persistent,
+	}
+
+	exchange, eventType, eventSource := p.cfg.ExchangeName, event.Type(), event.Source()
+
+	start := time.Now()
+	backoff := p.cfg.NackRetryBackoff
+	for attempt := 0; ; attempt++ {
+		recordPublishAttempt(exchange, eventType, eventSource)
+		recordPublishBytes(exchange, eventType, eventSource, len(bytes))
+
+		ack, err := p.publishAndAwaitConfirm(publishing)
+		dispatchTime := time.Since(start)
+		if err == nil {
+			result := "ack"
+			if !ack {
+				result = "nack"
+				err = errors.New("failed to publish message: nacked")
+			}
+			recordPublishConfirm(exchange, eventType, eventSource, result)
+			recordPublishDuration(exchange, eventType, eventSource, result, float64(dispatchTime.Milliseconds()))
+			if ack {
+				return http.StatusAccepted, dispatchTime, 0, nil
+			}
+		}
+		if errors.Is(err, errOutboxFull) {
+			recordPublishConfirm(exchange, eventType, eventSource, "rejected")
+			return http.StatusTooManyRequests, noDispatchTime, p.cfg.ConfirmTimeout, err
+		}
+		if attempt >= p.cfg.NackMaxRetries {
+			recordPublishConfirm(exchange, eventType, eventSource, "failed")
+			return http.StatusInternalServerError, noDispatchTime, 0, fmt.Errorf("failed to publish message after %d attempts: %w", attempt+1, err)
+		}
+		recordPublishRetry(exchange, eventType, eventSource)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (p *amqp091Publisher) publishAndAwaitConfirm(msg amqp.Publishing) (ack bool, err error) {
+	p.mu.RLock()
+	channel, box := p.channel, p.box
+	p.mu.RUnlock()
+
+	if channel == nil || box == nil {
+		return false, errors.New("amqp091 publisher: not connected")
+	}
+
+	release, err := box.acquire()
+	if err != nil {
+		return false, err
+	}
+	recordOutboxDepth(p.cfg.ExchangeName, box.depth())
+	defer func() {
+		release()
+		recordOutboxDepth(p.cfg.ExchangeName, box.depth())
+	}()
+
+	p.publishMu.Lock()
+	deliveryTag := channel.GetNextPublishSeqNo()
+	done := box.register(deliveryTag)
+	err = channel.Publish(
+		p.cfg.ExchangeName,
+		"",    // routing key
+		false, // mandatory
+		false, // immediate
+		msg)
+	p.publishMu.Unlock()
+	if err != nil {
+		box.forget(deliveryTag)
+		return false, fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil && !errors.Is(err, errChannelReset) {
+			// The outbox reports a nack as an error; Send tells a nack
+			// apart from a failed publish by ack=false with a nil error.
+			return false, nil
+		}
+		return err == nil, err
+	case <-time.After(p.cfg.ConfirmTimeout):
+		box.forget(deliveryTag)
+		return false, fmt.Errorf("timed out waiting %s for publisher confirm", p.cfg.ConfirmTimeout)
+	}
+}
+
+func (p *amqp091Publisher) Close() error {
+	// Stop the retry-listening goroutine before taking p.mu, which a
+	// reconnect in progress on that goroutine may be waiting for.
+	p.rmqHelper.SignalRetry(p.cfg.RetryChannel, false)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.box != nil {
+		p.box.failAll(errChannelReset)
+	}
+	p.rmqHelper.CloseRabbitMQConnections(p.connection, p.channel, p.logger)
+	return nil
+}
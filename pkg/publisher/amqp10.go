@@ -0,0 +1,199 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package publisher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+)
+
+// amqp10ReconnectBackoff bounds how often amqp10Publisher retries a failed
+// (re)connect, so a broker that's down doesn't get hammered with dials.
+const amqp10ReconnectBackoff = 2 * time.Second
+
+// amqp10Publisher publishes CloudEvents over an AMQP 1.0 link to the broker
+// exchange's address. Azure/go-amqp's Sender.Send blocks until the peer
+// settles the transfer, so unlike the 0-9-1 publisher no separate outbox is
+// needed to collect confirms - the in-flight bound is simply the number of
+// concurrent Send calls, capped by cfg.MaxInFlight via a semaphore.
+type amqp10Publisher struct {
+	cfg    Config
+	logger *zap.SugaredLogger
+
+	sem chan struct{}
+
+	mu     sync.RWMutex
+	client *amqp.Conn
+	sender *amqp.Sender
+
+	retry chan bool
+	stop  chan struct{}
+}
+
+func newAMQP10Publisher(cfg Config, logger *zap.SugaredLogger) (Publisher, error) {
+	p := &amqp10Publisher{
+		cfg:    cfg,
+		logger: logger,
+		sem:    make(chan struct{}, cfg.MaxInFlight),
+		retry:  make(chan bool, 1),
+		stop:   make(chan struct{}),
+	}
+
+	go p.reconnectLoop()
+
+	if err := p.connect(); err != nil {
+		logger.Errorf("error creating AMQP 1.0 connection: %s, waiting for a retry", err)
+		p.signalRetry()
+	}
+
+	return p, nil
+}
+
+// reconnectLoop re-dials whenever connect or Send signals the connection is
+// gone, so a broker restart or network blip is recovered from instead of
+// failing every later Send with a permanent "not connected" error.
+func (p *amqp10Publisher) reconnectLoop() {
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.retry:
+			p.logger.Warn("recreating AMQP 1.0 connection")
+			if err := p.connect(); err != nil {
+				p.logger.Errorf("error recreating AMQP 1.0 connection: %s, waiting for a retry", err)
+				time.Sleep(amqp10ReconnectBackoff)
+				p.signalRetry()
+			}
+		}
+	}
+}
+
+// signalRetry asks reconnectLoop to (re)connect, without blocking if a
+// retry is already pending.
+func (p *amqp10Publisher) signalRetry() {
+	select {
+	case p.retry <- true:
+	default:
+	}
+}
+
+func (p *amqp10Publisher) connect() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.ConfirmTimeout)
+	defer cancel()
+
+	client, err := amqp.Dial(ctx, p.cfg.BrokerURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to dial AMQP 1.0 broker: %w", err)
+	}
+
+	session, err := client.NewSession(ctx, nil)
+	if err != nil {
+		client.Close()
+		return fmt.Errorf("failed to open AMQP 1.0 session: %w", err)
+	}
+
+	sender, err := session.NewSender(ctx, p.cfg.ExchangeName, nil)
+	if err != nil {
+		client.Close()
+		return fmt.Errorf("failed to open AMQP 1.0 sender: %w", err)
+	}
+
+	p.mu.Lock()
+	if p.client != nil {
+		p.client.Close()
+	}
+	p.client, p.sender = client, sender
+	p.mu.Unlock()
+
+	recordConnectionChurn(string(ProtocolAMQP10))
+
+	return nil
+}
+
+func (p *amqp10Publisher) Send(ctx context.Context, event *cloudevents.Event, traceParent, traceState string) (int, time.Duration, time.Duration, error) {
+	bytes, headers, contentType, err := encodeAMQPMessage(p.cfg.Encoding, event, traceParent, traceState)
+	if err != nil {
+		return http.StatusBadRequest, noDispatchTime, 0, fmt.Errorf("failed to encode event, %w", err)
+	}
+
+	select {
+	case p.sem <- struct{}{}:
+		defer func() { <-p.sem }()
+	default:
+		return http.StatusTooManyRequests, noDispatchTime, p.cfg.ConfirmTimeout, errOutboxFull
+	}
+
+	p.mu.RLock()
+	sender := p.sender
+	p.mu.RUnlock()
+	if sender == nil {
+		p.signalRetry()
+		return http.StatusInternalServerError, noDispatchTime, 0, fmt.Errorf("amqp10 publisher: not connected")
+	}
+
+	appProps := make(map[string]interface{}, len(headers))
+	for k, v := range headers {
+		appProps[k] = v
+	}
+
+	msg := &amqp.Message{
+		Properties: &amqp.MessageProperties{
+			ContentType: stringPtr(contentType),
+		},
+		ApplicationProperties: appProps,
+		Data:                  [][]byte{bytes},
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, p.cfg.ConfirmTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := sender.Send(sendCtx, msg, nil); err != nil {
+		// The link or connection is presumed dead: drop it and ask
+		// reconnectLoop to dial a new one instead of leaving every later
+		// Send to fail the same way forever.
+		p.mu.Lock()
+		if p.client != nil {
+			p.client.Close()
+		}
+		p.client, p.sender = nil, nil
+		p.mu.Unlock()
+		p.signalRetry()
+		return http.StatusInternalServerError, noDispatchTime, 0, fmt.Errorf("failed to send AMQP 1.0 message: %w", err)
+	}
+
+	return http.StatusAccepted, time.Since(start), 0, nil
+}
+
+func (p *amqp10Publisher) Close() error {
+	close(p.stop)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client != nil {
+		return p.client.Close()
+	}
+	return nil
+}
+
+func stringPtr(s string) *string { return &s }
@@ -0,0 +1,102 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// cloudEventsHeaderPrefix is the AMQP application property prefix the
+// CloudEvents AMQP protocol binding reserves for context attributes in
+// binary content mode.
+const cloudEventsHeaderPrefix = "cloudEvents:"
+
+// encodeAMQPMessage maps event onto an AMQP body/headers/content-type
+// triple according to encoding. traceParent and traceState, when set, are
+// always carried as plain (non-CloudEvents) headers so the broker-side
+// dispatcher can continue the trace regardless of content mode.
+func encodeAMQPMessage(encoding CEEncoding, event *cloudevents.Event, traceParent, traceState string) ([]byte, amqp.Table, string, error) {
+	if encoding == CEEncodingBinary {
+		return encodeAMQPBinary(event, traceParent, traceState)
+	}
+	return encodeAMQPStructured(event, traceParent, traceState)
+}
+
+// encodeAMQPStructured marshals event as application/cloudevents+json,
+// keeping a hand-picked subset of attributes as plain headers for broker
+// side routing/tracing.
+func encodeAMQPStructured(event *cloudevents.Event, traceParent, traceState string) ([]byte, amqp.Table, string, error) {
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to marshal event, %w", err)
+	}
+
+	headers := amqp.Table{
+		"type":        event.Type(),
+		"source":      event.Source(),
+		"subject":     event.Subject(),
+		"traceparent": traceParent,
+		"tracestate":  traceState,
+	}
+	for key, val := range event.Extensions() {
+		headers[key] = val
+	}
+
+	return bytes, headers, "application/cloudevents+json", nil
+}
+
+// encodeAMQPBinary maps every CloudEvents context attribute (including
+// extensions) to a cloudEvents: prefixed AMQP header and puts the raw
+// payload in the body under its original datacontenttype, per the
+// CloudEvents AMQP binding's binary content mode.
+func encodeAMQPBinary(event *cloudevents.Event, traceParent, traceState string) ([]byte, amqp.Table, string, error) {
+	headers := amqp.Table{
+		cloudEventsHeaderPrefix + "specversion": event.SpecVersion(),
+		cloudEventsHeaderPrefix + "type":        event.Type(),
+		cloudEventsHeaderPrefix + "source":      event.Source(),
+		cloudEventsHeaderPrefix + "id":          event.ID(),
+		"traceparent":                           traceParent,
+		"tracestate":                            traceState,
+	}
+	if subject := event.Subject(); subject != "" {
+		headers[cloudEventsHeaderPrefix+"subject"] = subject
+	}
+	if t := event.Time(); !t.IsZero() {
+		headers[cloudEventsHeaderPrefix+"time"] = t.Format(time.RFC3339Nano)
+	}
+	if dataSchema := event.DataSchema(); dataSchema != "" {
+		headers[cloudEventsHeaderPrefix+"dataschema"] = dataSchema
+	}
+	if dct := event.DataContentType(); dct != "" {
+		headers[cloudEventsHeaderPrefix+"datacontenttype"] = dct
+	}
+	for key, val := range event.Extensions() {
+		headers[cloudEventsHeaderPrefix+key] = val
+	}
+
+	contentType := event.DataContentType()
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	return event.Data(), headers, contentType, nil
+}
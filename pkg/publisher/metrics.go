@@ -0,0 +1,142 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package publisher
+
+import (
+	"context"
+	"net/http"
+
+	"contrib.go.opencensus.io/exporter/prometheus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Publish-path metrics are recorded as OpenCensus measurements, the same
+// way ingress.StatsReporter already reports dispatch time/count. They're
+// additionally exported on their own Prometheus registry (see promExporter
+// and MetricsHandler below) rather than relying solely on whichever backend
+// env.SetupMetrics configures from the config-observability ConfigMap, so a
+// scraper has a route to hit even when that ConfigMap doesn't name
+// Prometheus as the metrics backend.
+var promExporter *prometheus.Exporter
+
+var (
+	exchangeKey    = tag.MustNewKey("exchange")
+	eventTypeKey   = tag.MustNewKey("event_type")
+	eventSourceKey = tag.MustNewKey("event_source")
+	resultKey      = tag.MustNewKey("result")
+	protocolKey    = tag.MustNewKey("protocol")
+
+	publishAttemptsM = stats.Int64(
+		"rabbitmq_ingress_publish_attempts",
+		"Number of publish attempts to RabbitMQ, including retries.",
+		stats.UnitDimensionless)
+	publishConfirmsM = stats.Int64(
+		"rabbitmq_ingress_publish_confirms",
+		"Number of publish outcomes, by result: ack or nack from RabbitMQ, rejected when the outbox is full, or failed after the last retry.",
+		stats.UnitDimensionless)
+	publishRetriesM = stats.Int64(
+		"rabbitmq_ingress_publish_retries",
+		"Number of publish retries after a nack or a failed publish attempt.",
+		stats.UnitDimensionless)
+	publishDurationM = stats.Float64(
+		"rabbitmq_ingress_publish_duration",
+		"Time from publish to ack or nack, by result.",
+		stats.UnitMilliseconds)
+	publishBytesM = stats.Int64(
+		"rabbitmq_ingress_publish_bytes",
+		"Bytes published.",
+		stats.UnitBytes)
+	outboxDepthM = stats.Int64(
+		"rabbitmq_ingress_outbox_depth",
+		"Number of publishes currently awaiting a confirm.",
+		stats.UnitDimensionless)
+	connectionChurnM = stats.Int64(
+		"rabbitmq_ingress_connection_churn",
+		"Number of times the publisher has (re)established its RabbitMQ connection.",
+		stats.UnitDimensionless)
+)
+
+func init() {
+	var err error
+	promExporter, err = prometheus.NewExporter(prometheus.Options{Namespace: "rabbitmq_ingress"})
+	if err != nil {
+		panic("publisher: failed to create Prometheus exporter: " + err.Error())
+	}
+	view.RegisterExporter(promExporter)
+
+	if err := view.Register(
+		&view.View{Measure: publishAttemptsM, Aggregation: view.Count(), TagKeys: []tag.Key{exchangeKey, eventTypeKey, eventSourceKey}},
+		&view.View{Measure: publishConfirmsM, Aggregation: view.Count(), TagKeys: []tag.Key{exchangeKey, eventTypeKey, eventSourceKey, resultKey}},
+		&view.View{Measure: publishRetriesM, Aggregation: view.Count(), TagKeys: []tag.Key{exchangeKey, eventTypeKey, eventSourceKey}},
+		&view.View{Measure: publishDurationM, Aggregation: view.Distribution(1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000), TagKeys: []tag.Key{exchangeKey, eventTypeKey, eventSourceKey, resultKey}},
+		&view.View{Measure: publishBytesM, Aggregation: view.Sum(), TagKeys: []tag.Key{exchangeKey, eventTypeKey, eventSourceKey}},
+		&view.View{Measure: outboxDepthM, Aggregation: view.LastValue(), TagKeys: []tag.Key{exchangeKey}},
+		&view.View{Measure: connectionChurnM, Aggregation: view.Count(), TagKeys: []tag.Key{protocolKey}},
+	); err != nil {
+		panic("publisher: failed to register metric views: " + err.Error())
+	}
+}
+
+// MetricsHandler serves the publish-path metrics registered in this package
+// in Prometheus exposition format. cmd/ingress mounts it at /metrics
+// alongside /healthz.
+func MetricsHandler() http.Handler {
+	return promExporter
+}
+
+func recordPublishAttempt(exchange, eventType, eventSource string) {
+	record(tag.Insert(exchangeKey, exchange), tag.Insert(eventTypeKey, eventType), tag.Insert(eventSourceKey, eventSource))(publishAttemptsM.M(1))
+}
+
+func recordPublishBytes(exchange, eventType, eventSource string, n int) {
+	record(tag.Insert(exchangeKey, exchange), tag.Insert(eventTypeKey, eventType), tag.Insert(eventSourceKey, eventSource))(publishBytesM.M(int64(n)))
+}
+
+func recordPublishConfirm(exchange, eventType, eventSource, result string) {
+	record(tag.Insert(exchangeKey, exchange), tag.Insert(eventTypeKey, eventType), tag.Insert(eventSourceKey, eventSource), tag.Insert(resultKey, result))(publishConfirmsM.M(1))
+}
+
+func recordPublishDuration(exchange, eventType, eventSource, result string, ms float64) {
+	record(tag.Insert(exchangeKey, exchange), tag.Insert(eventTypeKey, eventType), tag.Insert(eventSourceKey, eventSource), tag.Insert(resultKey, result))(publishDurationM.M(ms))
+}
+
+func recordPublishRetry(exchange, eventType, eventSource string) {
+	record(tag.Insert(exchangeKey, exchange), tag.Insert(eventTypeKey, eventType), tag.Insert(eventSourceKey, eventSource))(publishRetriesM.M(1))
+}
+
+func recordOutboxDepth(exchange string, depth int) {
+	record(tag.Insert(exchangeKey, exchange))(outboxDepthM.M(int64(depth)))
+}
+
+func recordConnectionChurn(protocol string) {
+	record(tag.Insert(protocolKey, protocol))(connectionChurnM.M(1))
+}
+
+// record builds the tagged context a single stats.Record call needs, without
+// every call site having to thread one through from its own ctx - these are
+// fire-and-forget process metrics, not per-request trace context.
+func record(tags ...tag.Mutator) func(m stats.Measurement) {
+	return func(m stats.Measurement) {
+		ctx, err := tag.New(context.Background(), tags...)
+		if err != nil {
+			return
+		}
+		stats.Record(ctx, m)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package publisher
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.uber.org/zap"
+)
+
+// errOutboxFull is returned by outbox.acquire when the in-flight slot limit
+// has been reached and the caller should back off rather than publish.
+var errOutboxFull = errors.New("outbox: too many in-flight publishes")
+
+// errChannelReset is delivered to every confirm still pending when the
+// underlying AMQP channel or connection is recreated, so waiting HTTP
+// handlers don't block forever on a confirmation that will never arrive.
+var errChannelReset = errors.New("outbox: amqp channel reset while waiting for confirm")
+
+// outbox tracks deferred publisher confirms for a single AMQP channel,
+// keyed by delivery tag, and bounds the number of publishes that may be
+// in flight at once. It lets many concurrent ServeHTTP goroutines share
+// one channel instead of each blocking the channel on dc.Wait().
+type outbox struct {
+	logger *zap.SugaredLogger
+
+	sem chan struct{} // bounds in-flight publishes; buffered channel used as a counting semaphore
+
+	mu      sync.Mutex
+	pending map[uint64]chan error
+	closed  bool
+
+	done chan struct{} // closed once the confirm/close listener goroutine returns
+
+	lastID uint64 // monotonic id source for publishers without their own delivery tag, e.g. streams
+}
+
+// newOutbox starts listening for confirms and channel closure on ch and
+// returns an outbox that will accept up to maxInFlight concurrent
+// publishes before acquire starts returning errOutboxFull.
+func newOutbox(ch *amqp.Channel, maxInFlight int, logger *zap.SugaredLogger) *outbox {
+	ob := newBareOutbox(maxInFlight, logger)
+
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, maxInFlight))
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	go ob.listen(confirms, closed)
+
+	return ob
+}
+
+// newBareOutbox returns an outbox with no confirm source wired up yet, for
+// publisher implementations (e.g. the stream publisher) that deliver
+// confirms through their own client rather than an *amqp.Channel.
+func newBareOutbox(maxInFlight int, logger *zap.SugaredLogger) *outbox {
+	return &outbox{
+		logger:  logger,
+		sem:     make(chan struct{}, maxInFlight),
+		pending: make(map[uint64]chan error),
+		done:    make(chan struct{}),
+	}
+}
+
+// nextID returns a monotonically increasing id for publishers that key
+// their confirms by something other than an AMQP 0-9-1 delivery tag.
+func (ob *outbox) nextID() uint64 {
+	return atomic.AddUint64(&ob.lastID, 1)
+}
+
+func (ob *outbox) listen(confirms <-chan amqp.Confirmation, closed <-chan *amqp.Error) {
+	defer close(ob.done)
+	for {
+		select {
+		case c, ok := <-confirms:
+			if !ok {
+				ob.failAll(errChannelReset)
+				return
+			}
+			ob.resolve(c.DeliveryTag, c.Ack)
+		case err := <-closed:
+			if err != nil {
+				ob.logger.Warnw("amqp channel closed while publishes were pending", zap.Error(err))
+			}
+			ob.failAll(errChannelReset)
+			return
+		}
+	}
+}
+
+// acquire reserves one of the bounded in-flight slots without blocking.
+// The caller must call the returned release func exactly once, whether or
+// not the publish ultimately succeeds.
+func (ob *outbox) acquire() (release func(), err error) {
+	select {
+	case ob.sem <- struct{}{}:
+		return func() { <-ob.sem }, nil
+	default:
+		return nil, errOutboxFull
+	}
+}
+
+// depth reports the current number of in-flight publishes, for metrics.
+func (ob *outbox) depth() int {
+	return len(ob.sem)
+}
+
+// register records that deliveryTag is awaiting a confirm and returns the
+// channel its outcome will be delivered on. The channel receives a nil
+// error for an ack, a non-nil error for a nack or a channel reset.
+func (ob *outbox) register(deliveryTag uint64) chan error {
+	done := make(chan error, 1)
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	if ob.closed {
+		done <- errChannelReset
+		return done
+	}
+	ob.pending[deliveryTag] = done
+	return done
+}
+
+// forget removes a delivery tag that the caller no longer cares about,
+// e.g. after its confirm wait timed out.
+func (ob *outbox) forget(deliveryTag uint64) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	delete(ob.pending, deliveryTag)
+}
+
+func (ob *outbox) resolve(deliveryTag uint64, ack bool) {
+	ob.mu.Lock()
+	done, found := ob.pending[deliveryTag]
+	if found {
+		delete(ob.pending, deliveryTag)
+	}
+	ob.mu.Unlock()
+
+	if !found {
+		return
+	}
+	if ack {
+		done <- nil
+	} else {
+		done <- errors.New("outbox: message nacked by broker")
+	}
+}
+
+// failAll resolves every still-pending confirm with err and marks the
+// outbox closed so any late register calls fail fast instead of hanging.
+func (ob *outbox) failAll(err error) {
+	ob.mu.Lock()
+	ob.closed = true
+	pending := ob.pending
+	ob.pending = make(map[uint64]chan error)
+	ob.mu.Unlock()
+
+	for _, done := range pending {
+		done <- err
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package publisher abstracts the ingress's outbound transport so the HTTP
+// handler doesn't need to know whether events end up on a classic AMQP
+// 0-9-1 exchange, an AMQP 1.0 link, or a RabbitMQ stream.
+package publisher
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+)
+
+// Protocol selects which Publisher implementation New constructs.
+type Protocol string
+
+const (
+	ProtocolAMQP091 Protocol = "amqp091"
+	ProtocolAMQP10  Protocol = "amqp10"
+	ProtocolStream  Protocol = "stream"
+)
+
+// CEEncoding selects how a CloudEvent is mapped onto an AMQP message, per
+// the CloudEvents AMQP protocol binding.
+type CEEncoding string
+
+const (
+	// CEEncodingStructured marshals the whole event as
+	// application/cloudevents+json in the message body.
+	CEEncodingStructured CEEncoding = "structured"
+	// CEEncodingBinary maps every context attribute to a cloudEvents:
+	// prefixed AMQP application property and puts the raw payload in the
+	// body under its original datacontenttype.
+	CEEncodingBinary CEEncoding = "binary"
+)
+
+// noDispatchTime signals that the dispatch step hasn't started, mirroring
+// the ingress HTTP handler's own noDuration sentinel.
+const noDispatchTime = -1
+
+// Publisher sends a CloudEvent to RabbitMQ and reports back the outcome in
+// the same shape the ingress HTTP handler already used for direct AMQP
+// 0-9-1 publishing: an HTTP-style status code, how long the publish took to
+// confirm, and - for a throttled publisher - how long the caller should
+// wait before retrying.
+type Publisher interface {
+	// Send publishes event and blocks until the broker confirms, nacks, or
+	// the publisher's configured timeout elapses. traceParent and
+	// traceState are the W3C trace context headers for the current span,
+	// if any.
+	Send(ctx context.Context, event *cloudevents.Event, traceParent, traceState string) (statusCode int, dispatchTime, retryAfter time.Duration, err error)
+
+	// Close releases any connections and stops background goroutines.
+	// Any publishes still in flight are failed with a clear error.
+	Close() error
+}
+
+// Config carries the settings every Publisher implementation understands,
+// even though not every field applies to every protocol.
+type Config struct {
+	BrokerURL string
+
+	// ExchangeName is used by the amqp091 and amqp10 publishers.
+	ExchangeName string
+	// StreamName is used by the stream publisher.
+	StreamName string
+
+	// Encoding selects structured vs binary CloudEvents content mode.
+	// Defaults to CEEncodingStructured.
+	Encoding CEEncoding
+
+	MaxInFlight      int
+	ConfirmTimeout   time.Duration
+	NackMaxRetries   int
+	NackRetryBackoff time.Duration
+
+	// RetryChannel, when non-nil, is signalled the same way
+	// rabbit.RabbitMQHelper's retry channel is: true to request a
+	// reconnect, false to stop listening for retries.
+	RetryChannel chan bool
+}
+
+// New constructs the Publisher implementation for protocol.
+func New(protocol Protocol, cfg Config, logger *zap.SugaredLogger) (Publisher, error) {
+	switch protocol {
+	case "", ProtocolAMQP091:
+		return newAMQP091Publisher(cfg, logger)
+	case ProtocolAMQP10:
+		return newAMQP10Publisher(cfg, logger)
+	case ProtocolStream:
+		return newStreamPublisher(cfg, logger)
+	default:
+		return nil, fmt.Errorf("publisher: unknown protocol %q", protocol)
+	}
+}
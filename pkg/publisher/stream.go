@@ -0,0 +1,221 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package publisher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/amqp"
+	"github.com/rabbitmq/rabbitmq-stream-go-client/pkg/stream"
+	"go.uber.org/zap"
+)
+
+// streamReconnectBackoff bounds how often streamPublisher retries a failed
+// (re)connect, so a broker that's down doesn't get hammered with dials.
+const streamReconnectBackoff = 2 * time.Second
+
+// streamPublisher publishes CloudEvents to a named RabbitMQ stream. Unlike
+// AMQP 0-9-1's broker-assigned delivery tags, the stream protocol has the
+// client assign each message's publishing ID; like the amqp091 publisher it
+// batches confirms through an outbox, keyed here by that publishing ID.
+type streamPublisher struct {
+	cfg    Config
+	logger *zap.SugaredLogger
+
+	env *stream.Environment
+
+	mu       sync.RWMutex
+	producer *stream.Producer
+	box      *outbox
+
+	retry chan bool
+	stop  chan struct{}
+}
+
+func newStreamPublisher(cfg Config, logger *zap.SugaredLogger) (Publisher, error) {
+	p := &streamPublisher{
+		cfg:    cfg,
+		logger: logger,
+		retry:  make(chan bool, 1),
+		stop:   make(chan struct{}),
+	}
+
+	go p.reconnectLoop()
+
+	if err := p.connect(); err != nil {
+		logger.Errorf("error creating RabbitMQ stream connection: %s, waiting for a retry", err)
+		p.signalRetry()
+	}
+
+	return p, nil
+}
+
+// reconnectLoop re-dials whenever connect or the confirm listener signals
+// the stream connection is gone, so a broker restart or network blip is
+// recovered from instead of failing every later Send with a permanent
+// "not connected" error.
+func (p *streamPublisher) reconnectLoop() {
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.retry:
+			p.logger.Warn("recreating RabbitMQ stream connection")
+			if err := p.connect(); err != nil {
+				p.logger.Errorf("error recreating RabbitMQ stream connection: %s, waiting for a retry", err)
+				time.Sleep(streamReconnectBackoff)
+				p.signalRetry()
+			}
+		}
+	}
+}
+
+// signalRetry asks reconnectLoop to (re)connect, without blocking if a
+// retry is already pending.
+func (p *streamPublisher) signalRetry() {
+	select {
+	case p.retry <- true:
+	default:
+	}
+}
+
+func (p *streamPublisher) connect() error {
+	opts := stream.NewEnvironmentOptions().SetUri(p.cfg.BrokerURL)
+	env, err := stream.NewEnvironment(opts)
+	if err != nil {
+		return fmt.Errorf("failed to create stream environment: %w", err)
+	}
+
+	if err := env.DeclareStream(p.cfg.StreamName, &stream.StreamOptions{}); err != nil && err != stream.StreamAlreadyExists {
+		env.Close()
+		return fmt.Errorf("failed to declare stream %q: %w", p.cfg.StreamName, err)
+	}
+
+	box := newBareOutbox(p.cfg.MaxInFlight, p.logger)
+
+	producerOpts := stream.NewProducerOptions()
+	producer, err := env.NewProducer(p.cfg.StreamName, producerOpts)
+	if err != nil {
+		env.Close()
+		return fmt.Errorf("failed to create stream producer: %w", err)
+	}
+
+	chConfirm := producer.NotifyPublishConfirmation()
+	go func() {
+		for confirmed := range chConfirm {
+			for _, msg := range confirmed {
+				box.resolve(uint64(msg.GetPublishingId()), msg.IsConfirmed())
+			}
+		}
+		box.failAll(errChannelReset)
+
+		// The confirmation channel only closes when the producer or its
+		// underlying connection has gone away, so that's the signal to
+		// dial a new one rather than leaving Send to fail forever.
+		p.mu.Lock()
+		if p.producer == producer {
+			p.producer, p.box = nil, nil
+		}
+		p.mu.Unlock()
+		p.signalRetry()
+	}()
+
+	p.mu.Lock()
+	if p.box != nil {
+		p.box.failAll(errChannelReset)
+	}
+	p.env, p.producer, p.box = env, producer, box
+	p.mu.Unlock()
+
+	recordConnectionChurn(string(ProtocolStream))
+
+	return nil
+}
+
+func (p *streamPublisher) Send(ctx context.Context, event *cloudevents.Event, traceParent, traceState string) (int, time.Duration, time.Duration, error) {
+	bytes, headers, contentType, err := encodeAMQPMessage(p.cfg.Encoding, event, traceParent, traceState)
+	if err != nil {
+		return http.StatusBadRequest, noDispatchTime, 0, fmt.Errorf("failed to encode event, %w", err)
+	}
+
+	p.mu.RLock()
+	producer, box := p.producer, p.box
+	p.mu.RUnlock()
+	if producer == nil || box == nil {
+		p.signalRetry()
+		return http.StatusInternalServerError, noDispatchTime, 0, fmt.Errorf("stream publisher: not connected")
+	}
+
+	release, err := box.acquire()
+	if err != nil {
+		return http.StatusTooManyRequests, noDispatchTime, p.cfg.ConfirmTimeout, err
+	}
+	defer release()
+
+	msg := amqp.NewMessage(bytes)
+	msg.Properties = &amqp.MessageProperties{ContentType: contentType}
+	msg.ApplicationProperties = map[string]interface{}{}
+	for k, v := range headers {
+		msg.ApplicationProperties[k] = v
+	}
+
+	// The stream protocol has the client assign the publishing ID, not the
+	// server, so it must be set on the message itself - the confirmation
+	// callback resolves the outbox by whatever ID msg.GetPublishingId()
+	// reports, which is this one, not some ID the client invents later.
+	publishingID := box.nextID()
+	msg.SetPublishingId(int64(publishingID))
+	done := box.register(publishingID)
+
+	start := time.Now()
+	if err := producer.Send(msg); err != nil {
+		box.forget(publishingID)
+		return http.StatusInternalServerError, noDispatchTime, 0, fmt.Errorf("failed to send stream message: %w", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return http.StatusInternalServerError, noDispatchTime, 0, err
+		}
+		return http.StatusAccepted, time.Since(start), 0, nil
+	case <-time.After(p.cfg.ConfirmTimeout):
+		box.forget(publishingID)
+		return http.StatusInternalServerError, noDispatchTime, 0, fmt.Errorf("timed out waiting %s for stream confirm", p.cfg.ConfirmTimeout)
+	}
+}
+
+func (p *streamPublisher) Close() error {
+	close(p.stop)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.box != nil {
+		p.box.failAll(errChannelReset)
+	}
+	if p.producer != nil {
+		p.producer.Close()
+	}
+	if p.env != nil {
+		return p.env.Close()
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package topology
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	rabbithole "github.com/michaelklishin/rabbit-hole/v2"
+)
+
+// httpClient declares topology directly against the RabbitMQ management
+// HTTP API via rabbit-hole, for clusters with no Cluster Operator CRDs
+// installed. Every Ensure/Delete call is synchronous: the management API
+// applies the change before responding, so there's nothing to poll for.
+type httpClient struct {
+	rmq *rabbithole.Client
+}
+
+func newHTTPClient(cfg Config) (Client, error) {
+	if cfg.ManagementURL == "" {
+		return nil, fmt.Errorf("topology: http backend requires a management URL")
+	}
+	rmq, err := rabbithole.NewClient(cfg.ManagementURL, cfg.Username, cfg.Password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build RabbitMQ management API client: %w", err)
+	}
+	return &httpClient{rmq: rmq}, nil
+}
+
+func (h *httpClient) EnsureExchange(ctx context.Context, spec ExchangeSpec) error {
+	resp, err := h.rmq.DeclareExchange(spec.Vhost, spec.Name, rabbithole.ExchangeSettings{
+		Type:       spec.Type,
+		Durable:    spec.Durable,
+		AutoDelete: spec.AutoDelete,
+	})
+	return checkResponse(resp, err, "declare exchange %q", spec.Name)
+}
+
+func (h *httpClient) DeleteExchange(ctx context.Context, vhost, name string) error {
+	resp, err := h.rmq.DeleteExchange(vhost, name)
+	return checkResponse(resp, err, "delete exchange %q", name)
+}
+
+func (h *httpClient) EnsureQueue(ctx context.Context, spec QueueSpec) error {
+	resp, err := h.rmq.DeclareQueue(spec.Vhost, spec.Name, rabbithole.QueueSettings{
+		Durable:    spec.Durable,
+		AutoDelete: spec.AutoDelete,
+		Arguments:  spec.Arguments,
+	})
+	return checkResponse(resp, err, "declare queue %q", spec.Name)
+}
+
+func (h *httpClient) DeleteQueue(ctx context.Context, vhost, name string) error {
+	resp, err := h.rmq.DeleteQueue(vhost, name)
+	return checkResponse(resp, err, "delete queue %q", name)
+}
+
+func (h *httpClient) EnsureBinding(ctx context.Context, spec BindingSpec) error {
+	resp, err := h.rmq.DeclareBinding(spec.Vhost, rabbithole.BindingInfo{
+		Source:          spec.Source,
+		Destination:     spec.Destination,
+		DestinationType: spec.DestinationType,
+		RoutingKey:      spec.RoutingKey,
+		Arguments:       spec.Arguments,
+	})
+	return checkResponse(resp, err, "declare binding %q -> %q", spec.Source, spec.Destination)
+}
+
+func (h *httpClient) DeleteBinding(ctx context.Context, spec BindingSpec) error {
+	resp, err := h.rmq.DeleteBinding(spec.Vhost, rabbithole.BindingInfo{
+		Source:          spec.Source,
+		Destination:     spec.Destination,
+		DestinationType: spec.DestinationType,
+		RoutingKey:      spec.RoutingKey,
+		Arguments:       spec.Arguments,
+	})
+	return checkResponse(resp, err, "delete binding %q -> %q", spec.Source, spec.Destination)
+}
+
+func (h *httpClient) Close() error { return nil }
+
+func checkResponse(resp *http.Response, err error, format string, args ...interface{}) error {
+	if err != nil {
+		return fmt.Errorf("failed to "+format+": %w", append(args, err)...)
+	}
+	if resp != nil && resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to "+format+": management API returned %s", append(args, resp.Status)...)
+	}
+	return nil
+}
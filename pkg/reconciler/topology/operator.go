@@ -0,0 +1,216 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package topology
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	topologyv1beta1 "knative.dev/eventing-rabbitmq/third_party/pkg/apis/rabbitmq.com/v1beta1"
+	rabbitmqv1beta1 "knative.dev/eventing-rabbitmq/third_party/pkg/client/clientset/versioned/typed/rabbitmq.com/v1beta1"
+)
+
+const (
+	readyPollInterval = 250 * time.Millisecond
+	readyPollTimeout  = 30 * time.Second
+)
+
+// operatorClient declares topology as RabbitmqV1beta1 custom resources and
+// waits for the Cluster Operator to report them Ready before an Ensure*
+// call returns.
+type operatorClient struct {
+	client    rabbitmqv1beta1.RabbitmqV1beta1Interface
+	namespace string
+}
+
+func newOperatorClient(cfg Config) (Client, error) {
+	if cfg.RestConfig == nil {
+		return nil, fmt.Errorf("topology: operator backend requires a Kubernetes RestConfig")
+	}
+	client, err := rabbitmqv1beta1.NewForConfig(cfg.RestConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build RabbitMQ Cluster Operator client: %w", err)
+	}
+	return &operatorClient{client: client, namespace: cfg.Namespace}, nil
+}
+
+func (o *operatorClient) EnsureExchange(ctx context.Context, spec ExchangeSpec) error {
+	exchange := &topologyv1beta1.Exchange{
+		ObjectMeta: metav1.ObjectMeta{Name: spec.Name},
+		Spec: topologyv1beta1.ExchangeSpec{
+			Name:       spec.Name,
+			Type:       spec.Type,
+			Vhost:      spec.Vhost,
+			Durable:    spec.Durable,
+			AutoDelete: spec.AutoDelete,
+		},
+	}
+	if _, err := o.client.Exchanges(o.namespace).Create(ctx, exchange, metav1.CreateOptions{}); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create Exchange %q: %w", spec.Name, err)
+		}
+		if err := o.updateExchange(ctx, exchange); err != nil {
+			return err
+		}
+	}
+	return o.waitReady(ctx, func(ctx context.Context) (bool, error) {
+		got, err := o.client.Exchanges(o.namespace).Get(ctx, spec.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return got.Status.Conditions.IsTrueFor("Ready"), nil
+	})
+}
+
+func (o *operatorClient) DeleteExchange(ctx context.Context, vhost, name string) error {
+	if err := o.client.Exchanges(o.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete Exchange %q: %w", name, err)
+	}
+	return nil
+}
+
+func (o *operatorClient) EnsureQueue(ctx context.Context, spec QueueSpec) error {
+	queue := &topologyv1beta1.Queue{
+		ObjectMeta: metav1.ObjectMeta{Name: spec.Name},
+		Spec: topologyv1beta1.QueueSpec{
+			Name:       spec.Name,
+			Vhost:      spec.Vhost,
+			Durable:    spec.Durable,
+			AutoDelete: spec.AutoDelete,
+			Arguments:  spec.Arguments,
+		},
+	}
+	if _, err := o.client.Queues(o.namespace).Create(ctx, queue, metav1.CreateOptions{}); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create Queue %q: %w", spec.Name, err)
+		}
+		if err := o.updateQueue(ctx, queue); err != nil {
+			return err
+		}
+	}
+	return o.waitReady(ctx, func(ctx context.Context) (bool, error) {
+		got, err := o.client.Queues(o.namespace).Get(ctx, spec.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return got.Status.Conditions.IsTrueFor("Ready"), nil
+	})
+}
+
+func (o *operatorClient) DeleteQueue(ctx context.Context, vhost, name string) error {
+	if err := o.client.Queues(o.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete Queue %q: %w", name, err)
+	}
+	return nil
+}
+
+func (o *operatorClient) EnsureBinding(ctx context.Context, spec BindingSpec) error {
+	name := bindingName(spec)
+	binding := &topologyv1beta1.Binding{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: topologyv1beta1.BindingSpec{
+			Vhost:           spec.Vhost,
+			Source:          spec.Source,
+			Destination:     spec.Destination,
+			DestinationType: spec.DestinationType,
+			RoutingKey:      spec.RoutingKey,
+			Arguments:       spec.Arguments,
+		},
+	}
+	if _, err := o.client.Bindings(o.namespace).Create(ctx, binding, metav1.CreateOptions{}); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create Binding %q: %w", name, err)
+		}
+		if err := o.updateBinding(ctx, binding); err != nil {
+			return err
+		}
+	}
+	return o.waitReady(ctx, func(ctx context.Context) (bool, error) {
+		got, err := o.client.Bindings(o.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return got.Status.Conditions.IsTrueFor("Ready"), nil
+	})
+}
+
+func (o *operatorClient) DeleteBinding(ctx context.Context, spec BindingSpec) error {
+	name := bindingName(spec)
+	if err := o.client.Bindings(o.namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete Binding %q: %w", name, err)
+	}
+	return nil
+}
+
+func (o *operatorClient) Close() error { return nil }
+
+// updateExchange reconciles spec drift on an Exchange that already exists,
+// so a repeat Ensure call is idempotent instead of failing with
+// AlreadyExists the way a bare Create would on every reconcile after the
+// first.
+func (o *operatorClient) updateExchange(ctx context.Context, desired *topologyv1beta1.Exchange) error {
+	existing, err := o.client.Exchanges(o.namespace).Get(ctx, desired.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get existing Exchange %q: %w", desired.Name, err)
+	}
+	existing.Spec = desired.Spec
+	if _, err := o.client.Exchanges(o.namespace).Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update existing Exchange %q: %w", desired.Name, err)
+	}
+	return nil
+}
+
+// updateQueue is updateExchange's counterpart for Queues.
+func (o *operatorClient) updateQueue(ctx context.Context, desired *topologyv1beta1.Queue) error {
+	existing, err := o.client.Queues(o.namespace).Get(ctx, desired.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get existing Queue %q: %w", desired.Name, err)
+	}
+	existing.Spec = desired.Spec
+	if _, err := o.client.Queues(o.namespace).Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update existing Queue %q: %w", desired.Name, err)
+	}
+	return nil
+}
+
+// updateBinding is updateExchange's counterpart for Bindings.
+func (o *operatorClient) updateBinding(ctx context.Context, desired *topologyv1beta1.Binding) error {
+	existing, err := o.client.Bindings(o.namespace).Get(ctx, desired.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get existing Binding %q: %w", desired.Name, err)
+	}
+	existing.Spec = desired.Spec
+	if _, err := o.client.Bindings(o.namespace).Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update existing Binding %q: %w", desired.Name, err)
+	}
+	return nil
+}
+
+func (o *operatorClient) waitReady(ctx context.Context, check wait.ConditionWithContextFunc) error {
+	if err := wait.PollUntilContextTimeout(ctx, readyPollInterval, readyPollTimeout, true, check); err != nil {
+		return fmt.Errorf("timed out waiting for Cluster Operator to report Ready: %w", err)
+	}
+	return nil
+}
+
+func bindingName(spec BindingSpec) string {
+	return fmt.Sprintf("%s-to-%s", spec.Source, spec.Destination)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package topology lets the broker and trigger reconcilers declare and tear
+// down RabbitMQ exchanges, queues, and bindings without hard-coding how
+// those objects actually get to RabbitMQ. The operator backend manages them
+// as Cluster Operator custom resources; the http backend talks to the
+// RabbitMQ management HTTP API directly for clusters that don't have those
+// CRDs installed.
+package topology
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/client-go/rest"
+)
+
+// Backend selects which Client implementation New constructs.
+type Backend string
+
+const (
+	// BackendOperator declares topology as RabbitMQ Cluster Operator
+	// custom resources (Exchanges/Queues/Bindings) and waits for the
+	// operator to report them Ready.
+	BackendOperator Backend = "operator"
+	// BackendHTTP declares topology directly against the RabbitMQ
+	// management HTTP API, for clusters with no Cluster Operator CRDs.
+	BackendHTTP Backend = "http"
+)
+
+// ExchangeSpec describes an exchange to declare.
+type ExchangeSpec struct {
+	Vhost      string
+	Name       string
+	Type       string
+	Durable    bool
+	AutoDelete bool
+}
+
+// QueueSpec describes a queue to declare.
+type QueueSpec struct {
+	Vhost      string
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Arguments  map[string]interface{}
+}
+
+// BindingSpec describes a binding between an exchange and a queue or
+// another exchange.
+type BindingSpec struct {
+	Vhost           string
+	Source          string
+	Destination     string
+	DestinationType string // "queue" or "exchange"
+	RoutingKey      string
+	Arguments       map[string]interface{}
+}
+
+// Client declares and tears down broker/trigger topology. Every method is
+// synchronous: once it returns without error the object exists (or, for a
+// Delete, no longer does) on the RabbitMQ cluster. The operator backend
+// blocks internally until the Cluster Operator reports the custom resource
+// Ready, so callers don't need their own reconciliation loop either way.
+//
+// Client is not rabbitmqv1beta1.RabbitmqV1beta1Interface (the
+// BindingsGetter/ExchangesGetter/QueuesGetter/... set of per-resource
+// clients): it covers only exchanges, queues, and bindings, with Ensure and
+// Delete calls in place of Create/Get/Update/Delete. operatorClient is built
+// on that interface's Exchanges, Queues, and Bindings clients; httpClient
+// doesn't use the Kubernetes API at all.
+type Client interface {
+	EnsureExchange(ctx context.Context, spec ExchangeSpec) error
+	DeleteExchange(ctx context.Context, vhost, name string) error
+
+	EnsureQueue(ctx context.Context, spec QueueSpec) error
+	DeleteQueue(ctx context.Context, vhost, name string) error
+
+	EnsureBinding(ctx context.Context, spec BindingSpec) error
+	DeleteBinding(ctx context.Context, spec BindingSpec) error
+
+	Close() error
+}
+
+// Config carries the settings either backend needs; only the fields the
+// selected Backend actually uses must be set.
+type Config struct {
+	// RestConfig authenticates against the Kubernetes API server. Required
+	// for BackendOperator.
+	RestConfig *rest.Config
+	// Namespace is the namespace the operator backend creates custom
+	// resources in.
+	Namespace string
+
+	// ManagementURL, Username, and Password authenticate against the
+	// RabbitMQ HTTP management API. Required for BackendHTTP.
+	ManagementURL string
+	Username      string
+	Password      string
+}
+
+// EnvConfig reads the Backend from RABBITMQ_TOPOLOGY_BACKEND (default
+// "operator"); a reconciler can embed it in its own envconfig struct
+// instead of redeclaring that tag.
+type EnvConfig struct {
+	Backend Backend `envconfig:"RABBITMQ_TOPOLOGY_BACKEND" default:"operator"`
+}
+
+// NewFromEnv is New, taking the Backend from an already-processed
+// EnvConfig instead of requiring the caller to name it explicitly.
+func NewFromEnv(env EnvConfig, cfg Config) (Client, error) {
+	return New(env.Backend, cfg)
+}
+
+// New constructs the Client for backend.
+func New(backend Backend, cfg Config) (Client, error) {
+	switch backend {
+	case "", BackendOperator:
+		return newOperatorClient(cfg)
+	case BackendHTTP:
+		return newHTTPClient(cfg)
+	default:
+		return nil, fmt.Errorf("topology: unknown backend %q", backend)
+	}
+}